@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/xdg-go/scram"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+var (
+	zkAuthUser     string
+	zkAuthPassword string
+)
+
+// buildPrometheusRoundTripper wires up whichever auth scheme was configured
+// via the --prometheus-* flags (mTLS always applies on top of one of basic
+// auth, a bearer token, or an OAuth2 client-credentials flow), falling back
+// to a plain transport when none are set.
+func buildPrometheusRoundTripper() (http.RoundTripper, error) {
+	tlsConfig, err := buildTLSConfig(flPrometheusTLSCA, flPrometheusTLSCert, flPrometheusTLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	base := http.DefaultTransport
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		base = transport
+	}
+
+	switch {
+	case flPrometheusOAuth2TokenURL != "":
+		secret, err := readSecretFile(flPrometheusOAuth2ClientSecretFile)
+		if err != nil {
+			return nil, err
+		}
+
+		cc := clientcredentials.Config{
+			ClientID:     flPrometheusOAuth2ClientID,
+			ClientSecret: secret,
+			TokenURL:     flPrometheusOAuth2TokenURL,
+		}
+
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: base})
+
+		return &oauth2.Transport{Source: cc.TokenSource(ctx), Base: base}, nil
+
+	case flPrometheusBearerTokenFile != "":
+		token, err := readSecretFile(flPrometheusBearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return &bearerTokenRoundTripper{token: token, next: base}, nil
+
+	case flPrometheusBasicAuthUser != "":
+		password, err := readSecretFile(flPrometheusBasicAuthPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return &basicAuthRoundTripper{username: flPrometheusBasicAuthUser, password: password, next: base}, nil
+
+	default:
+		return base, nil
+	}
+}
+
+// buildAdminHTTPRoundTripper wires up whichever auth scheme was configured
+// via the --admin-http-* flags (mTLS always applies on top of basic auth or a
+// bearer token), falling back to a plain transport when none are set.
+func buildAdminHTTPRoundTripper() (http.RoundTripper, error) {
+	tlsConfig, err := buildTLSConfig(flAdminHTTPTLSCA, flAdminHTTPTLSCert, flAdminHTTPTLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	base := http.DefaultTransport
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		base = transport
+	}
+
+	switch {
+	case flAdminHTTPBearerTokenFile != "":
+		token, err := readSecretFile(flAdminHTTPBearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return &bearerTokenRoundTripper{token: token, next: base}, nil
+
+	case flAdminHTTPBasicAuthUser != "":
+		password, err := readSecretFile(flAdminHTTPBasicAuthPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return &basicAuthRoundTripper{username: flAdminHTTPBasicAuthUser, password: password, next: base}, nil
+
+	default:
+		return base, nil
+	}
+}
+
+type basicAuthRoundTripper struct {
+	username string
+	password string
+	next     http.RoundTripper
+}
+
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.SetBasicAuth(rt.username, rt.password)
+	return rt.next.RoundTrip(req)
+}
+
+type bearerTokenRoundTripper struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (rt *bearerTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+rt.token)
+	return rt.next.RoundTrip(req)
+}
+
+// cloneRequest copies a request before mutating its headers, per the
+// http.RoundTripper contract which forbids mutating the original request.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = req.Header.Clone()
+	return r
+}
+
+// buildTLSConfig builds a *tls.Config from a CA bundle and/or client
+// cert/key, shared by the Prometheus, Kafka and admin-http TLS flags. Returns
+// a nil config (not an error) when none of the three are set, so callers can
+// leave TLS untouched on their underlying client.
+func buildTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if caFile != "" {
+		caCert, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS CA file %s: %v", caFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file %s", caFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS client cert/key %s/%s: %v", certFile, keyFile, err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret file %s: %v", path, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// loadZKAuth reads the "user:password" pair used for ZooKeeper SASL/DIGEST-MD5
+// auth from --zk-auth-file, if set.
+func loadZKAuth() error {
+	if flZkAuthFile == "" {
+		return nil
+	}
+
+	creds, err := readSecretFile(flZkAuthFile)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(creds, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("--zk-auth-file must contain \"user:password\"")
+	}
+
+	zkAuthUser, zkAuthPassword = parts[0], parts[1]
+
+	return nil
+}
+
+// addZKAuth authenticates a ZooKeeper connection when --zk-auth-file is set.
+func addZKAuth(conn *zk.Conn) error {
+	if flZkAuthFile == "" {
+		return nil
+	}
+
+	return conn.AddAuth("digest", []byte(zkAuthUser+":"+zkAuthPassword))
+}
+
+// desiredACL is the ACL written onto /topicmappr/* znodes: world-readable by
+// default, or restricted to the configured digest principal once
+// --zk-auth-file is set so only topicmappr's service principal can read them.
+func desiredACL() []zk.ACL {
+	if flZkAuthFile == "" {
+		return zk.WorldACL(zk.PermAll)
+	}
+
+	return zk.DigestACL(zk.PermAll, zkAuthUser, zkAuthPassword)
+}
+
+// configureKafkaAuth applies the --kafka-tls-*/--kafka-sasl-* flags onto a
+// sarama client config, so --output=kafka can reach brokers that require TLS
+// and/or SASL rather than only plaintext, unauthenticated ones.
+func configureKafkaAuth(conf *sarama.Config) error {
+	tlsConfig, err := buildTLSConfig(flKafkaTLSCA, flKafkaTLSCert, flKafkaTLSKey)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config = tlsConfig
+	}
+
+	if flKafkaSASLMechanism == "" {
+		return nil
+	}
+
+	password, err := readSecretFile(flKafkaSASLPasswordFile)
+	if err != nil {
+		return err
+	}
+
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.User = flKafkaSASLUsername
+	conf.Net.SASL.Password = password
+	conf.Net.SASL.Mechanism = sarama.SASLMechanism(flKafkaSASLMechanism)
+
+	switch flKafkaSASLMechanism {
+	case sarama.SASLTypePlaintext:
+		// Nothing further to configure; sarama handles PLAIN itself.
+	case sarama.SASLTypeSCRAMSHA256:
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &xdgSCRAMClient{HashGeneratorFcn: scram.SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &xdgSCRAMClient{HashGeneratorFcn: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("unknown --kafka-sasl-mechanism %q: must be %q, %q or %q", flKafkaSASLMechanism, sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512)
+	}
+
+	return nil
+}
+
+// xdgSCRAMClient adapts github.com/xdg-go/scram's client to sarama's
+// SCRAMClient interface, the standard glue needed since sarama doesn't bring
+// its own SCRAM implementation.
+type xdgSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *xdgSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+
+	return nil
+}
+
+func (c *xdgSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *xdgSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serveMetrics serves the /metrics and /healthz HTTP endpoints. It blocks for
+// as long as the server runs and exits the process if the server fails, so
+// callers should run it in its own goroutine.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+
+	log.Infof("serving metrics on %s", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("metrics server failed: %v", err)
+	}
+}
+
+// healthzHandler reports unhealthy once the data held in the output sink has
+// gone stale for longer than a few refresh intervals, so operators can alert
+// on the fetcher falling behind rather than only noticing via topicmappr.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	ts := atomic.LoadInt64(&lastSuccessUnix)
+	if ts == 0 {
+		http.Error(w, "no successful sync yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if flRefreshInterval > 0 {
+		staleness := time.Since(time.Unix(ts, 0))
+		if maxStaleness := 3 * flRefreshInterval; staleness > maxStaleness {
+			http.Error(w, fmt.Sprintf("data is stale: last sync %s ago", staleness), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// runDaemon runs the fetch/process cycle on --refresh-interval until the process
+// is terminated, rather than exiting after a single iteration.
+func runDaemon() {
+	log.Infof("starting daemon mode, refresh interval: %s", flRefreshInterval)
+
+	if err := runIteration(); err != nil {
+		log.Errorf("sync iteration failed: %v", err)
+	}
+
+	ticker := time.NewTicker(flRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := runIteration(); err != nil {
+			log.Errorf("sync iteration failed: %v", err)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/samuel/go-zookeeper/zk"
 	"github.com/sirupsen/logrus"
@@ -33,16 +34,54 @@ type topicPartitionSize map[string]partitionSize
 var (
 	log *logrus.Logger
 
-	flPrometheusURL          string
-	flPrometheusQueryTimeout time.Duration
-	flZkAddr                 string
-	flPartitionSizeQuery     string
-	flBrokerStorageQuery     string
-	flBrokerIDLabel          string
-	flDryRun                 bool
-
-	zkChroot  string
-	apiClient api.Client
+	flPrometheusURLs                     []string
+	flPrometheusQueryTimeout             time.Duration
+	flZkAddr                             string
+	flPartitionSizeQueries               []string
+	flBrokerStorageQueries               []string
+	flPartitionSizeLookback              time.Duration
+	flBrokerIDLabel                      string
+	flDryRun                             bool
+	flRefreshInterval                    time.Duration
+	flMetricsListenAddr                  string
+	flValidateAgainstKafka               bool
+	flMissingPartitionStrategy           string
+	flOutput                             string
+	flKafkaBrokers                       string
+	flKafkaMetricsTopic                  string
+	flKafkaMetricsTopicReplicationFactor int
+	flAdminHTTPURL                       string
+
+	flPrometheusBasicAuthUser          string
+	flPrometheusBasicAuthPasswordFile  string
+	flPrometheusBearerTokenFile        string
+	flPrometheusOAuth2ClientID         string
+	flPrometheusOAuth2ClientSecretFile string
+	flPrometheusOAuth2TokenURL         string
+	flPrometheusTLSCA                  string
+	flPrometheusTLSCert                string
+	flPrometheusTLSKey                 string
+
+	flKafkaSASLMechanism    string
+	flKafkaSASLUsername     string
+	flKafkaSASLPasswordFile string
+	flKafkaTLSCA            string
+	flKafkaTLSCert          string
+	flKafkaTLSKey           string
+
+	flAdminHTTPBasicAuthUser         string
+	flAdminHTTPBasicAuthPasswordFile string
+	flAdminHTTPBearerTokenFile       string
+	flAdminHTTPTLSCA                 string
+	flAdminHTTPTLSCert               string
+	flAdminHTTPTLSKey                string
+
+	flZkAuthFile string
+
+	zkChroot string
+	zkAddr   string
+
+	promSources []promSource
 )
 
 func init() {
@@ -55,24 +94,61 @@ func init() {
 	})
 	log.SetOutput(os.Stdout)
 
-	flag.StringVar(&flPrometheusURL, "prometheus-url", "", "Prometheus URL")
+	flag.StringArrayVar(&flPrometheusURLs, "prometheus-url", nil, "Prometheus URL. Repeat to federate across multiple sources (e.g. split Prometheus/Thanos deployments); results are merged")
 	flag.DurationVar(&flPrometheusQueryTimeout, "prometheus-query-timeout", 30*time.Second, "Timeout for Prometheus queries")
 	flag.StringVar(&flZkAddr, "zk-addr", "zookeeper:2181", "Zookeeper host")
-	flag.StringVar(&flPartitionSizeQuery, "partition-size-query", "", "Prometheus query to get partition size by topic")
-	flag.StringVar(&flBrokerStorageQuery, "broker-storage-query", "", "Prometheus query to get broker storage free space")
+	flag.StringArrayVar(&flPartitionSizeQueries, "partition-size-query", nil, "Prometheus query to get partition size by topic. Repeat to pair one query per --prometheus-url, or pass once to reuse across all sources")
+	flag.StringArrayVar(&flBrokerStorageQueries, "broker-storage-query", nil, "Prometheus query to get broker storage free space. Repeat to pair one query per --prometheus-url, or pass once to reuse across all sources")
+	flag.DurationVar(&flPartitionSizeLookback, "partition-size-lookback", 0, "If set, query partition sizes over this lookback window and take the max sample per partition, so a transient scrape gap doesn't make a partition look artificially small")
 	flag.StringVar(&flBrokerIDLabel, "broker-id-label", "broker_id", "Prometheus label for broker ID")
 	flag.BoolVar(&flDryRun, "dry-run", false, "Fetch the metrics but don't write them to ZooKeeper, instead print them")
+	flag.DurationVar(&flRefreshInterval, "refresh-interval", 0, "If set, run as a daemon and re-fetch/re-write on this interval instead of exiting after one run")
+	flag.StringVar(&flMetricsListenAddr, "metrics-listen-addr", ":9090", "Address to serve /metrics and /healthz on when running with --refresh-interval")
+	flag.BoolVar(&flValidateAgainstKafka, "validate-against-kafka", false, "Cross-validate Prometheus data against the topics/partitions/brokers registered in ZooKeeper before writing")
+	flag.StringVar(&flMissingPartitionStrategy, "missing-partition-strategy", missingPartitionStrategyLog, "How to handle partitions registered in Kafka but missing from the Prometheus partition-size query: \"log\" or \"fill-mean\"")
+	flag.StringVar(&flOutput, "output", outputZK, "Where to write the fetched metrics: \"zk\", \"kafka\" or \"admin-http\"")
+	flag.StringVar(&flKafkaBrokers, "kafka-brokers", "", "Comma-separated list of Kafka bootstrap brokers, required when --output=kafka")
+	flag.StringVar(&flKafkaMetricsTopic, "kafka-metrics-topic", "__topicmappr_metrics", "Compacted Kafka topic to write metrics to when --output=kafka")
+	flag.IntVar(&flKafkaMetricsTopicReplicationFactor, "kafka-metrics-topic-replication-factor", 0, "Replication factor to create --kafka-metrics-topic with if it doesn't exist. Defaults to min(3, number of --kafka-brokers)")
+	flag.StringVar(&flAdminHTTPURL, "admin-http-url", "", "Base URL of the admin HTTP endpoint to POST metrics to when --output=admin-http, e.g. for a Redpanda Admin API shim")
+	flag.StringVar(&flPrometheusBasicAuthUser, "prometheus-basic-auth-user", "", "Username for HTTP basic auth against --prometheus-url")
+	flag.StringVar(&flPrometheusBasicAuthPasswordFile, "prometheus-basic-auth-password-file", "", "File containing the password for --prometheus-basic-auth-user")
+	flag.StringVar(&flPrometheusBearerTokenFile, "prometheus-bearer-token-file", "", "File containing a bearer token to send with every Prometheus request")
+	flag.StringVar(&flPrometheusOAuth2ClientID, "prometheus-oauth2-client-id", "", "OAuth2 client ID for the Prometheus client-credentials flow")
+	flag.StringVar(&flPrometheusOAuth2ClientSecretFile, "prometheus-oauth2-client-secret-file", "", "File containing the OAuth2 client secret, used with --prometheus-oauth2-client-id")
+	flag.StringVar(&flPrometheusOAuth2TokenURL, "prometheus-oauth2-token-url", "", "OAuth2 token endpoint, enables the client-credentials flow when set")
+	flag.StringVar(&flPrometheusTLSCA, "prometheus-tls-ca", "", "PEM-encoded CA bundle to verify --prometheus-url against")
+	flag.StringVar(&flPrometheusTLSCert, "prometheus-tls-cert", "", "PEM-encoded client certificate for mTLS against --prometheus-url")
+	flag.StringVar(&flPrometheusTLSKey, "prometheus-tls-key", "", "PEM-encoded client key for mTLS against --prometheus-url")
+	flag.StringVar(&flKafkaSASLMechanism, "kafka-sasl-mechanism", "", "SASL mechanism for --kafka-brokers: \"PLAIN\", \"SCRAM-SHA-256\" or \"SCRAM-SHA-512\". Unset disables SASL")
+	flag.StringVar(&flKafkaSASLUsername, "kafka-sasl-username", "", "SASL username for --kafka-brokers")
+	flag.StringVar(&flKafkaSASLPasswordFile, "kafka-sasl-password-file", "", "File containing the SASL password for --kafka-sasl-username")
+	flag.StringVar(&flKafkaTLSCA, "kafka-tls-ca", "", "PEM-encoded CA bundle to verify --kafka-brokers against")
+	flag.StringVar(&flKafkaTLSCert, "kafka-tls-cert", "", "PEM-encoded client certificate for mTLS against --kafka-brokers")
+	flag.StringVar(&flKafkaTLSKey, "kafka-tls-key", "", "PEM-encoded client key for mTLS against --kafka-brokers")
+	flag.StringVar(&flAdminHTTPBasicAuthUser, "admin-http-basic-auth-user", "", "Username for HTTP basic auth against --admin-http-url")
+	flag.StringVar(&flAdminHTTPBasicAuthPasswordFile, "admin-http-basic-auth-password-file", "", "File containing the password for --admin-http-basic-auth-user")
+	flag.StringVar(&flAdminHTTPBearerTokenFile, "admin-http-bearer-token-file", "", "File containing a bearer token to send with every --admin-http-url request")
+	flag.StringVar(&flAdminHTTPTLSCA, "admin-http-tls-ca", "", "PEM-encoded CA bundle to verify --admin-http-url against")
+	flag.StringVar(&flAdminHTTPTLSCert, "admin-http-tls-cert", "", "PEM-encoded client certificate for mTLS against --admin-http-url")
+	flag.StringVar(&flAdminHTTPTLSKey, "admin-http-tls-key", "", "PEM-encoded client key for mTLS against --admin-http-url")
+	flag.StringVar(&flZkAuthFile, "zk-auth-file", "", "File containing \"user:password\" to authenticate to ZooKeeper with SASL/DIGEST-MD5; also switches written znode ACLs from world-readable to digest-restricted")
 	flag.Parse()
 }
 
-func promQuery(q string) (model.Value, error) {
+// promQuery runs an instant query against a single source, recording
+// duration/error/empty-result metrics labeled by query name and source.
+func promQuery(client api.Client, source, name, q string) (model.Value, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), flPrometheusQueryTimeout)
 	defer cancel()
 
-	v1api := v1.NewAPI(apiClient)
+	timer := prometheus.NewTimer(promQueryDuration.WithLabelValues(name, source))
+	v1api := v1.NewAPI(client)
 	result, warnings, err := v1api.Query(ctx, q, time.Now())
+	timer.ObserveDuration()
 
 	if err != nil {
+		promQueryErrorsTotal.WithLabelValues(name, source).Inc()
 		return nil, err
 	}
 
@@ -80,60 +156,53 @@ func promQuery(q string) (model.Value, error) {
 		log.Warning(warnings)
 	}
 
+	if vectorVal, ok := result.(model.Vector); ok && len(vectorVal) == 0 {
+		promQueryEmptyResultsTotal.WithLabelValues(name, source).Inc()
+	}
+
 	return result, nil
 }
 
-func getBrokerFreeSpace() *brokerStorageFree {
-	m := make(brokerStorageFree)
-
-	result, err := promQuery(flBrokerStorageQuery)
-	if err != nil {
-		log.Fatalf("Error getting broker storage free space from Prometheus: %v", err)
-	}
-
-	if result.Type() == model.ValVector {
-		vectorVal := result.(model.Vector)
+// promQueryRange runs a range query against a single source over the last
+// lookback window, recording the same metrics as promQuery.
+func promQueryRange(client api.Client, source, name, q string, lookback time.Duration) (model.Matrix, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), flPrometheusQueryTimeout)
+	defer cancel()
 
-		for _, elem := range vectorVal {
-			bid := string(elem.Metric[model.LabelName(flBrokerIDLabel)])
-			m[bid] = brokerStorageFreeValue{StorageFree: float64(elem.Value)}
-		}
+	now := time.Now()
+	step := lookback / 12
+	if step < 15*time.Second {
+		step = 15 * time.Second
 	}
 
-	return &m
-}
+	timer := prometheus.NewTimer(promQueryDuration.WithLabelValues(name, source))
+	v1api := v1.NewAPI(client)
+	result, warnings, err := v1api.QueryRange(ctx, q, v1.Range{Start: now.Add(-lookback), End: now, Step: step})
+	timer.ObserveDuration()
 
-func getPartitionSizes() *topicPartitionSize {
-	m := make(topicPartitionSize)
-
-	result, err := promQuery(flPartitionSizeQuery)
 	if err != nil {
-		log.Errorf("Error getting partition sizes from Prometheus: %v", err)
-		os.Exit(1)
+		promQueryErrorsTotal.WithLabelValues(name, source).Inc()
+		return nil, err
 	}
 
-	if result.Type() == model.ValVector {
-		vectorVal := result.(model.Vector)
-
-		for _, elem := range vectorVal {
-			topic := string(elem.Metric["topic"])
-			partition := string(elem.Metric["partition"])
+	if len(warnings) > 0 {
+		log.Warning(warnings)
+	}
 
-			v, ok := m[topic]
-			if !ok {
-				v = make(partitionSize)
-			}
+	matrixVal, ok := result.(model.Matrix)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result type %s for range query", result.Type())
+	}
 
-			v[partition] = partitionSizeValue{Size: float64(elem.Value)}
-			m[topic] = v
-		}
+	if len(matrixVal) == 0 {
+		promQueryEmptyResultsTotal.WithLabelValues(name, source).Inc()
 	}
 
-	return &m
+	return matrixVal, nil
 }
 
-func processData(zkConn *zk.Conn, brokerMetrics *brokerStorageFree, partitionMapping *topicPartitionSize) error {
-	defer zkConn.Close()
+func processData(sink OutputSink, brokerMetrics *brokerStorageFree, partitionMapping *topicPartitionSize) error {
+	defer sink.Close()
 
 	topicPartitionSizeData, err := json.Marshal(*partitionMapping)
 	if err != nil {
@@ -185,19 +254,25 @@ func processData(zkConn *zk.Conn, brokerMetrics *brokerStorageFree, partitionMap
 		}
 
 	default:
-		if err := writeToZookeeper(zkConn, "partitionmeta", topicPartitionSizeData); err != nil {
+		if err := sink.Write("partitionmeta", topicPartitionSizeData); err != nil {
 			return err
 		}
 
-		if err := writeToZookeeper(zkConn, "brokermetrics", brokerMetricsData); err != nil {
+		if err := sink.Write("brokermetrics", brokerMetricsData); err != nil {
 			return err
 		}
 	}
 
+	var partitionCount int
+	for _, partitions := range *partitionMapping {
+		partitionCount += len(partitions)
+	}
+	recordSyncSuccess(len(*partitionMapping), partitionCount, len(*brokerMetrics))
+
 	return nil
 }
 
-func writeToZookeeper(zkConn *zk.Conn, path string, data []byte) error {
+func writeToZookeeper(zkConn *zk.Conn, path string, data []byte) (err error) {
 	const root = "/topicmappr"
 
 	// If our cluster is a zk chroot we need to use it too.
@@ -211,17 +286,27 @@ func writeToZookeeper(zkConn *zk.Conn, path string, data []byte) error {
 
 	path = dir + "/" + path
 
+	timer := prometheus.NewTimer(zkWriteDuration.WithLabelValues(path))
+	defer timer.ObserveDuration()
+	defer func() {
+		if err != nil {
+			zkWriteErrorsTotal.WithLabelValues(path).Inc()
+		}
+	}()
+
 	// Remove the old node.
-	err := zkConn.Delete(path, 0)
+	err = zkConn.Delete(path, 0)
 	if err != nil && err != zk.ErrNoNode {
 		return fmt.Errorf("unable to delete path %s. err: %v", path, err)
 	}
 
+	wantACL := desiredACL()
+
 	acl, _, err := zkConn.GetACL(dir)
 	if err != nil {
 		if err == zk.ErrNoNode {
 			// Create the directory node if it is missing
-			_, err = zkConn.Create(dir, nil, 0, zk.WorldACL(zk.PermAll))
+			_, err = zkConn.Create(dir, nil, 0, wantACL)
 			if err != nil && err != zk.ErrNodeExists {
 				return fmt.Errorf("unable to create node %s. err: %v", dir, err)
 			}
@@ -229,16 +314,16 @@ func writeToZookeeper(zkConn *zk.Conn, path string, data []byte) error {
 			return fmt.Errorf("unable to get node %s acl. err: %v", dir, err)
 		}
 	} else {
-		// Ensure that we have WorldACL with PermAll
-		var waclExists bool
-		wacl := zk.WorldACL(zk.PermAll)[0]
+		// Ensure that the configured ACL (WorldACL by default, DigestACL when
+		// --zk-auth-file is set) is in place.
+		var aclExists bool
 		for _, a := range acl {
-			if a == wacl {
-				waclExists = true
+			if a == wantACL[0] {
+				aclExists = true
 				break
 			}
 		}
-		if !waclExists {
+		if !aclExists {
 			return fmt.Errorf("zookeeper node %s has wrong ACL: %v", dir, acl)
 		}
 	}
@@ -246,7 +331,7 @@ func writeToZookeeper(zkConn *zk.Conn, path string, data []byte) error {
 	// Create the data node
 	log.Printf("writing data to %s", path)
 
-	_, err = zkConn.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+	_, err = zkConn.Create(path, data, 0, wantACL)
 	if err != nil {
 		return fmt.Errorf("unable to create path %s. err: %v", path, err)
 	}
@@ -254,47 +339,78 @@ func writeToZookeeper(zkConn *zk.Conn, path string, data []byte) error {
 	return nil
 }
 
-func main() {
-	// Prometheus client
-	if flPrometheusURL == "" {
-		log.Fatal("Please provide prometheus-url")
+// runIteration fetches the current broker/partition metrics from Prometheus
+// and writes them out, opening a fresh output sink (per --output) for the run
+// since processData closes it once it is done.
+func runIteration() error {
+	brokerMetrics, err := getBrokerFreeSpace()
+	if err != nil {
+		return err
 	}
 
-	var err error
-	apiClient, err = api.NewClient(api.Config{
-		Address: flPrometheusURL,
-	})
-
+	partitionMapping, err := getPartitionSizes()
 	if err != nil {
-		log.Fatalf("Error creating Prometheus client: %v", err)
+		return err
 	}
 
-	// Zookeeper connection
-	if flZkAddr == "" {
-		log.Fatal("please provide the zookeeper host with --zk-addr")
+	if err := validateAgainstKafka(partitionMapping, brokerMetrics); err != nil {
+		return err
 	}
 
-	var zkAddr string
-	if pos := strings.IndexByte(flZkAddr, '/'); pos >= 0 {
-		zkAddr = flZkAddr[:pos]
-		zkChroot = flZkAddr[pos:]
+	// In dry-run, processData never calls sink.Write, so skip building the
+	// real sink entirely - it may require config/infra unrelated to the run
+	// (e.g. --kafka-brokers) that the user has no reason to provide yet.
+	var sink OutputSink
+	if flDryRun {
+		sink = noopSink{}
 	} else {
-		zkAddr = flZkAddr
+		sink, err = newOutputSink()
+		if err != nil {
+			return fmt.Errorf("error setting up %s output sink: %v", flOutput, err)
+		}
 	}
 
-	zk.DefaultLogger = log.WithField("logger", "zk")
-	zkConn, _, err := zk.Connect([]string{zkAddr}, 20*time.Second)
+	return processData(sink, brokerMetrics, partitionMapping)
+}
+
+func main() {
+	// Prometheus client(s)
+	var err error
 
+	promSources, err = buildPromSources()
 	if err != nil {
-		log.Fatalf("Error creating zookeeper connection: %v", err)
+		log.Fatalf("Error setting up Prometheus source(s): %v", err)
 	}
 
-	// Get data
-	brokerMetrics := getBrokerFreeSpace()
-	partitionMapping := getPartitionSizes()
+	if err := loadZKAuth(); err != nil {
+		log.Fatalf("Error loading --zk-auth-file: %v", err)
+	}
 
-	err = processData(zkConn, brokerMetrics, partitionMapping)
-	if err != nil {
-		log.Fatalf("Failed to process data: %v", err)
+	// Zookeeper connection. Required when writing to ZK or when cross-validating
+	// against the cluster metadata that still lives there, optional otherwise
+	// (e.g. --output=kafka against a KRaft cluster).
+	if flZkAddr == "" && (flOutput == outputZK || flValidateAgainstKafka) {
+		log.Fatal("please provide the zookeeper host with --zk-addr")
+	}
+
+	if flZkAddr != "" {
+		if pos := strings.IndexByte(flZkAddr, '/'); pos >= 0 {
+			zkAddr = flZkAddr[:pos]
+			zkChroot = flZkAddr[pos:]
+		} else {
+			zkAddr = flZkAddr
+		}
 	}
+
+	zk.DefaultLogger = log.WithField("logger", "zk")
+
+	if flRefreshInterval <= 0 {
+		if err := runIteration(); err != nil {
+			log.Fatalf("Failed to process data: %v", err)
+		}
+		return
+	}
+
+	go serveMetrics(flMetricsListenAddr)
+	runDaemon()
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// lastSuccessUnix holds the unix timestamp of the last successful sync,
+// accessed atomically since it's read from the metrics HTTP handler goroutine.
+var lastSuccessUnix int64
+
+var (
+	promQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metricsfetcher_prometheus_query_duration_seconds",
+		Help:    "Duration of Prometheus queries performed by the fetcher.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query", "source"})
+
+	promQueryErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsfetcher_prometheus_query_errors_total",
+		Help: "Number of Prometheus queries that returned an error.",
+	}, []string{"query", "source"})
+
+	promQueryEmptyResultsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsfetcher_prometheus_query_empty_results_total",
+		Help: "Number of Prometheus queries that returned zero series.",
+	}, []string{"query", "source"})
+
+	zkWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "metricsfetcher_zookeeper_write_duration_seconds",
+		Help:    "Duration of writes to ZooKeeper.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path"})
+
+	zkWriteErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsfetcher_zookeeper_write_errors_total",
+		Help: "Number of ZooKeeper writes that returned an error.",
+	}, []string{"path"})
+
+	lastSyncTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metricsfetcher_last_sync_timestamp_seconds",
+		Help: "Unix timestamp of the last successful sync to the output sink.",
+	})
+
+	topicsProduced = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metricsfetcher_topics_produced",
+		Help: "Number of topics present in the partition size data produced by the last sync.",
+	})
+
+	partitionsProduced = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metricsfetcher_partitions_produced",
+		Help: "Number of partitions present in the partition size data produced by the last sync.",
+	})
+
+	brokersProduced = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metricsfetcher_brokers_produced",
+		Help: "Number of brokers present in the broker storage data produced by the last sync.",
+	})
+
+	staleEntitiesDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsfetcher_stale_entities_dropped_total",
+		Help: "Number of entities reported by Prometheus that no longer exist in Kafka and were dropped before writing.",
+	}, []string{"kind"})
+
+	missingPartitionsFilledTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "metricsfetcher_missing_partitions_filled_total",
+		Help: "Number of partitions registered in Kafka but missing from Prometheus that were filled with a fallback size.",
+	})
+
+	missingPartitionsObserved = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "metricsfetcher_missing_partitions_observed",
+		Help: "Number of partitions registered in Kafka but missing from the Prometheus partition-size query in the last sync.",
+	})
+
+	degradedQueryTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "metricsfetcher_degraded_query_total",
+		Help: "Number of syncs where at least one federated Prometheus source failed but others succeeded, so the result is from partial data.",
+	}, []string{"query"})
+
+	// dataStalenessSeconds reports -1 until the first successful sync.
+	dataStalenessSeconds = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "metricsfetcher_data_staleness_seconds",
+		Help: "Seconds since the data currently held in the output sink was last refreshed.",
+	}, func() float64 {
+		ts := atomic.LoadInt64(&lastSuccessUnix)
+		if ts == 0 {
+			return -1
+		}
+		return time.Since(time.Unix(ts, 0)).Seconds()
+	})
+)
+
+// recordSyncSuccess updates the sync bookkeeping metrics after a successful iteration.
+func recordSyncSuccess(topics, partitions, brokers int) {
+	now := time.Now()
+	atomic.StoreInt64(&lastSuccessUnix, now.Unix())
+	lastSyncTimestamp.Set(float64(now.Unix()))
+	topicsProduced.Set(float64(topics))
+	partitionsProduced.Set(float64(partitions))
+	brokersProduced.Set(float64(brokers))
+}
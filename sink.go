@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	outputZK        = "zk"
+	outputKafka     = "kafka"
+	outputAdminHTTP = "admin-http"
+)
+
+// OutputSink persists the named datasets ("partitionmeta", "brokermetrics")
+// produced by processData to wherever topicmappr reads them back from.
+type OutputSink interface {
+	Write(name string, data []byte) error
+	Close()
+}
+
+// noopSink is used in --dry-run, where processData never calls Write.
+type noopSink struct{}
+
+func (noopSink) Write(name string, data []byte) error { return nil }
+func (noopSink) Close()                               {}
+
+// newOutputSink builds the OutputSink selected by --output.
+func newOutputSink() (OutputSink, error) {
+	switch flOutput {
+	case outputZK:
+		zkConn, _, err := zk.Connect([]string{zkAddr}, 20*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("error creating zookeeper connection: %v", err)
+		}
+
+		if err := addZKAuth(zkConn); err != nil {
+			zkConn.Close()
+			return nil, fmt.Errorf("error authenticating to zookeeper: %v", err)
+		}
+
+		return &zkSink{conn: zkConn}, nil
+
+	case outputKafka:
+		return newKafkaSink()
+
+	case outputAdminHTTP:
+		return newAdminHTTPSink()
+
+	default:
+		return nil, fmt.Errorf("unknown output sink %q", flOutput)
+	}
+}
+
+// zkSink writes to ZooKeeper, the original and still default behavior.
+type zkSink struct {
+	conn *zk.Conn
+}
+
+func (s *zkSink) Write(name string, data []byte) error {
+	return writeToZookeeper(s.conn, name, data)
+}
+
+func (s *zkSink) Close() {
+	s.conn.Close()
+}
+
+// kafkaSink writes to a dedicated compacted Kafka topic, keyed by dataset
+// name, for KRaft-only clusters where there is no ZooKeeper for topicmappr to
+// read from directly.
+type kafkaSink struct {
+	admin    sarama.ClusterAdmin
+	producer sarama.SyncProducer
+	topic    string
+}
+
+func newKafkaSink() (*kafkaSink, error) {
+	if flKafkaBrokers == "" {
+		return nil, fmt.Errorf("--kafka-brokers is required when --output=kafka")
+	}
+
+	brokers := strings.Split(flKafkaBrokers, ",")
+
+	conf := sarama.NewConfig()
+	conf.Producer.Return.Successes = true
+
+	if err := configureKafkaAuth(conf); err != nil {
+		return nil, err
+	}
+
+	admin, err := sarama.NewClusterAdmin(brokers, conf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kafka admin client: %v", err)
+	}
+
+	if err := ensureMetricsTopic(admin, flKafkaMetricsTopic, len(brokers)); err != nil {
+		admin.Close()
+		return nil, err
+	}
+
+	producer, err := sarama.NewSyncProducer(brokers, conf)
+	if err != nil {
+		admin.Close()
+		return nil, fmt.Errorf("error creating kafka producer: %v", err)
+	}
+
+	return &kafkaSink{admin: admin, producer: producer, topic: flKafkaMetricsTopic}, nil
+}
+
+// ensureMetricsTopic creates the metrics topic with a compacting cleanup
+// policy if it doesn't already exist, so the latest partitionmeta/
+// brokermetrics key always survives log cleanup.
+func ensureMetricsTopic(admin sarama.ClusterAdmin, topic string, brokerCount int) error {
+	topics, err := admin.ListTopics()
+	if err != nil {
+		return fmt.Errorf("error listing kafka topics: %v", err)
+	}
+
+	if _, ok := topics[topic]; ok {
+		return nil
+	}
+
+	replicationFactor := int16(flKafkaMetricsTopicReplicationFactor)
+	if replicationFactor <= 0 {
+		// Default to 3-way replication, or less on small/staging/KRaft-in-a-box
+		// clusters that don't have 3 brokers to spread it across.
+		replicationFactor = 3
+		if brokerCount < int(replicationFactor) {
+			replicationFactor = int16(brokerCount)
+		}
+	}
+
+	log.Infof("creating compacted metrics topic %s with replication factor %d", topic, replicationFactor)
+
+	cleanupPolicy := "compact"
+	err = admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     1,
+		ReplicationFactor: replicationFactor,
+		ConfigEntries: map[string]*string{
+			"cleanup.policy": &cleanupPolicy,
+		},
+	}, false)
+	if err != nil && err != sarama.ErrTopicAlreadyExists {
+		return fmt.Errorf("error creating topic %s: %v", topic, err)
+	}
+
+	return nil
+}
+
+func (s *kafkaSink) Write(name string, data []byte) error {
+	_, _, err := s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.topic,
+		Key:   sarama.StringEncoder(name),
+		Value: sarama.ByteEncoder(data),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing %s to kafka topic %s: %v", name, s.topic, err)
+	}
+
+	return nil
+}
+
+func (s *kafkaSink) Close() {
+	s.producer.Close()
+	s.admin.Close()
+}
+
+// adminHTTPSink POSTs the JSON datasets to a Redpanda (or compatible) Admin
+// API endpoint, one request per dataset name.
+type adminHTTPSink struct {
+	client *http.Client
+	url    string
+}
+
+func newAdminHTTPSink() (*adminHTTPSink, error) {
+	if flAdminHTTPURL == "" {
+		return nil, fmt.Errorf("--admin-http-url is required when --output=admin-http")
+	}
+
+	rt, err := buildAdminHTTPRoundTripper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminHTTPSink{
+		client: &http.Client{Timeout: 30 * time.Second, Transport: rt},
+		url:    strings.TrimSuffix(flAdminHTTPURL, "/"),
+	}, nil
+}
+
+func (s *adminHTTPSink) Write(name string, data []byte) error {
+	url := s.url + "/" + name
+
+	resp, err := s.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error posting %s to %s: %v", name, url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s posting %s to %s", resp.Status, name, url)
+	}
+
+	return nil
+}
+
+func (s *adminHTTPSink) Close() {}
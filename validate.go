@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	kazoo "github.com/krallistic/kazoo-go"
+)
+
+const (
+	missingPartitionStrategyLog      = "log"
+	missingPartitionStrategyFillMean = "fill-mean"
+)
+
+// validateAgainstKafka cross-checks the Prometheus-derived data against the
+// topics/partitions and brokers actually registered in Kafka before it gets
+// written out, so stale scrape labels from decommissioned brokers or deleted
+// topics don't poison topicmappr's input. It is a no-op unless
+// --validate-against-kafka is set.
+func validateAgainstKafka(partitionMapping *topicPartitionSize, brokerMetrics *brokerStorageFree) error {
+	if !flValidateAgainstKafka {
+		return nil
+	}
+
+	// kazoo-go opens and owns its own ZooKeeper connection internally and
+	// doesn't expose it, so the --zk-auth-file SASL credentials used for the
+	// write path (sink.go's zkSink) cannot be threaded through here. Refuse
+	// the combination explicitly rather than silently reading cluster
+	// metadata unauthenticated and failing with an opaque ZK error.
+	if flZkAuthFile != "" {
+		return fmt.Errorf("--validate-against-kafka does not support --zk-auth-file: kazoo-go does not expose its ZooKeeper connection for authentication")
+	}
+
+	kz, err := kazoo.NewKazoo([]string{zkAddr}, &kazoo.Config{Chroot: zkChroot})
+	if err != nil {
+		return fmt.Errorf("error connecting to zookeeper for kafka cluster metadata: %v", err)
+	}
+	defer kz.Close()
+
+	liveTopics, err := kz.Topics()
+	if err != nil {
+		return fmt.Errorf("error listing kafka topics: %v", err)
+	}
+
+	liveBrokers, err := kz.Brokers()
+	if err != nil {
+		return fmt.Errorf("error listing kafka brokers: %v", err)
+	}
+
+	if err := validatePartitionSizes(partitionMapping, liveTopics); err != nil {
+		return err
+	}
+
+	validateBrokerMetrics(brokerMetrics, liveBrokers)
+
+	return nil
+}
+
+// validatePartitionSizes drops partitions that Prometheus reported but that no
+// longer exist in Kafka, and surfaces (optionally filling, per
+// --missing-partition-strategy) partitions that are registered in Kafka but
+// absent from the Prometheus result.
+func validatePartitionSizes(partitionMapping *topicPartitionSize, liveTopics kazoo.TopicList) error {
+	live := make(map[string]map[int32]bool, len(liveTopics))
+
+	for _, t := range liveTopics {
+		livePartitions, err := t.Partitions()
+		if err != nil {
+			return fmt.Errorf("error listing partitions for topic %s: %v", t.Name, err)
+		}
+
+		ids := make(map[int32]bool, len(livePartitions))
+		for _, p := range livePartitions {
+			ids[p.ID] = true
+		}
+		live[t.Name] = ids
+	}
+
+	for topic, partitions := range *partitionMapping {
+		livePartitions, topicExists := live[topic]
+
+		for partition := range partitions {
+			id, err := strconv.Atoi(partition)
+			if err != nil || !topicExists || !livePartitions[int32(id)] {
+				log.Warnf("dropping stale partition %s/%s: no longer registered in kafka", topic, partition)
+				staleEntitiesDroppedTotal.WithLabelValues("partition").Inc()
+				delete(partitions, partition)
+			}
+		}
+
+		if len(partitions) == 0 {
+			delete(*partitionMapping, topic)
+		}
+	}
+
+	var missing int
+
+	for topic, livePartitions := range live {
+		// Read-only: don't create an entry for a topic Prometheus has no data
+		// for at all, that would write a spurious "topic": {} into the output.
+		existingPartitions := (*partitionMapping)[topic]
+		mean, haveMean := meanPartitionSize(existingPartitions)
+
+		for id := range livePartitions {
+			key := strconv.Itoa(int(id))
+			if _, ok := existingPartitions[key]; ok {
+				continue
+			}
+
+			missing++
+			log.Warnf("partition %s/%s is registered in kafka but missing from prometheus", topic, key)
+
+			if flMissingPartitionStrategy != missingPartitionStrategyFillMean {
+				continue
+			}
+
+			if !haveMean {
+				log.Warnf("cannot fill missing partition %s/%s: no sibling partitions in topic %s to average", topic, key, topic)
+				continue
+			}
+
+			partitions, ok := (*partitionMapping)[topic]
+			if !ok {
+				partitions = make(partitionSize)
+				(*partitionMapping)[topic] = partitions
+			}
+
+			partitions[key] = partitionSizeValue{Size: mean}
+			missingPartitionsFilledTotal.Inc()
+		}
+	}
+
+	missingPartitionsObserved.Set(float64(missing))
+
+	return nil
+}
+
+// meanPartitionSize returns the mean size of the given (genuinely present)
+// sibling partitions, and whether there were any to average at all.
+func meanPartitionSize(partitions partitionSize) (float64, bool) {
+	if len(partitions) == 0 {
+		return 0, false
+	}
+
+	var total float64
+	for _, v := range partitions {
+		total += v.Size
+	}
+
+	return total / float64(len(partitions)), true
+}
+
+// validateBrokerMetrics drops broker storage labels for brokers that are no
+// longer registered in Kafka (e.g. decommissioned nodes still reporting
+// stale metrics under their old broker ID).
+func validateBrokerMetrics(brokerMetrics *brokerStorageFree, liveBrokers map[int32]string) {
+	for bid := range *brokerMetrics {
+		id, err := strconv.Atoi(bid)
+		if err != nil || liveBrokers[int32(id)] == "" {
+			log.Warnf("dropping stale broker storage metric for broker %s: not registered in kafka", bid)
+			staleEntitiesDroppedTotal.WithLabelValues("broker").Inc()
+			delete(*brokerMetrics, bid)
+		}
+	}
+}